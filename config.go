@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+)
+
+//Config is the top-level shape of the file passed via -config. YAML and JSON are both
+//accepted since JSON is a valid subset of YAML.
+type Config struct {
+	HTTPPort            int            `yaml:"http_port"`
+	ProxyCheckers       int            `yaml:"proxy_checkers"`
+	ProxyConnectTimeout int            `yaml:"proxy_connect_timeout"` //seconds
+	Endpoints           []EndpointSpec `yaml:"endpoints"`
+	ProxyPoolOurs       []string       `yaml:"proxy_pool_ours"`
+	ProxyPoolThirdparty []string       `yaml:"proxy_pool_thirdparty"`
+	BypassDomains       []string       `yaml:"bypass_domains"`
+	DefaultProtocol     string         `yaml:"default_protocol"`
+	HealthCheckInterval int            `yaml:"health_check_interval"` //seconds, used by -watch
+	StatsFile           string         `yaml:"stats_file"`
+	Strategy            string         `yaml:"strategy"` //upstream selection strategy used by the serve subcommand
+}
+
+//loads and parses a Config from the given file path
+func loadConfig(filePath string) (*Config, error) {
+
+	data, err := ioutil.ReadFile(filePath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg Config
+
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+
+	if cfg.DefaultProtocol == "" {
+		cfg.DefaultProtocol = protocolHTTP
+	}
+
+	if len(cfg.Endpoints) == 0 {
+		return nil, errors.New("config must specify at least one endpoint")
+	}
+
+	return &cfg, nil
+}
+
+//parses the proxy pool sections of a Config into a single list of Proxy, skipping any
+//lines that fail to parse
+func (cfg *Config) proxies() []Proxy {
+
+	var proxies []Proxy
+
+	for _, pool := range [][]string{cfg.ProxyPoolOurs, cfg.ProxyPoolThirdparty} {
+
+		for _, line := range pool {
+
+			proxy, err := stringToProxy(line, cfg.DefaultProtocol)
+
+			if err == nil {
+				proxies = append(proxies, proxy)
+			}
+		}
+	}
+
+	return proxies
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"github.com/fatih/color"
+	"gopkg.in/yaml.v3"
+	"sort"
+	"strings"
+	"time"
+)
+
+//EndpointSpec is one entry in a Config's endpoints list. A plain YAML string is accepted
+//as shorthand for an EndpointSpec with only URL set (success = a 2xx/3xx status); the
+//richer form lets a proxy that merely gets a 200-with-captcha-page be classified correctly
+type EndpointSpec struct {
+	URL              string `yaml:"url"`
+	RequiredStatuses []int  `yaml:"required_statuses"`
+	BodyContains     string `yaml:"body_contains"`
+}
+
+//UnmarshalYAML accepts either a bare URL string or a mapping with url/required_statuses/body_contains
+func (e *EndpointSpec) UnmarshalYAML(value *yaml.Node) error {
+
+	if value.Kind == yaml.ScalarNode {
+		e.URL = value.Value
+		return nil
+	}
+
+	type rawSpec EndpointSpec
+
+	var raw rawSpec
+
+	if err := value.Decode(&raw); err != nil {
+		return err
+	}
+
+	*e = EndpointSpec(raw)
+
+	return nil
+}
+
+//isSuccess applies this endpoint's success predicate to a completed request
+func (e EndpointSpec) isSuccess(statusCode int, body string) bool {
+
+	if len(e.RequiredStatuses) > 0 {
+
+		matched := false
+
+		for _, required := range e.RequiredStatuses {
+			if statusCode == required {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			return false
+		}
+
+	} else if statusCode < 200 || statusCode >= 400 {
+		return false
+	}
+
+	if e.BodyContains != "" && !strings.Contains(body, e.BodyContains) {
+		return false
+	}
+
+	return true
+}
+
+//EndpointResult is a single proxy's outcome against a single endpoint, as stored in a
+//ProxyAggregate's Endpoints map
+type EndpointResult struct {
+	StatusCode int
+	Latency    time.Duration
+	Success    bool
+	Error      string
+}
+
+//ProxyAggregate rolls up a proxy's results across every endpoint it was tested against
+//into a per-endpoint map plus a single comparable Score
+type ProxyAggregate struct {
+	Proxy     Proxy
+	Endpoints map[string]EndpointResult
+	Score     float64
+}
+
+//aggregateResults groups a flat, possibly multi-endpoint result list by proxy and scores
+//each one, sorted best (highest score) first
+func aggregateResults(results []ProxyTestResult) []ProxyAggregate {
+
+	byProxy := make(map[string]*ProxyAggregate)
+	var order []string
+
+	for _, result := range results {
+
+		key := result.ProxyUsed.key()
+
+		agg, ok := byProxy[key]
+
+		if !ok {
+			agg = &ProxyAggregate{Proxy: result.ProxyUsed, Endpoints: make(map[string]EndpointResult)}
+			byProxy[key] = agg
+			order = append(order, key)
+		}
+
+		agg.Endpoints[result.Endpoint] = EndpointResult{
+			StatusCode: result.StatusCode,
+			Latency:    result.Speed,
+			Success:    result.Success,
+			Error:      result.Error,
+		}
+	}
+
+	aggregates := make([]ProxyAggregate, 0, len(order))
+
+	for _, key := range order {
+		agg := byProxy[key]
+		agg.Score = scoreAggregate(*agg)
+		aggregates = append(aggregates, *agg)
+	}
+
+	sort.SliceStable(aggregates, func(i, j int) bool {
+		return aggregates[i].Score > aggregates[j].Score
+	})
+
+	return aggregates
+}
+
+//scoreAggregate favors a higher endpoint success rate first, then lower average latency
+//among the endpoints that succeeded
+func scoreAggregate(agg ProxyAggregate) float64 {
+
+	if len(agg.Endpoints) == 0 {
+		return 0
+	}
+
+	var successes int
+	var totalLatency time.Duration
+
+	for _, result := range agg.Endpoints {
+		if result.Success {
+			successes++
+			totalLatency += result.Latency
+		}
+	}
+
+	if successes == 0 {
+		return 0
+	}
+
+	successRate := float64(successes) / float64(len(agg.Endpoints))
+	avgLatencySeconds := totalLatency.Seconds() / float64(successes)
+
+	return successRate*1000 - avgLatencySeconds
+}
+
+//sortResultsByScore reorders a flat result list so every proxy's rows are grouped
+//together in aggregate-score order (fastest working proxies first)
+func sortResultsByScore(results []ProxyTestResult, aggregates []ProxyAggregate) []ProxyTestResult {
+
+	grouped := make(map[string][]ProxyTestResult)
+
+	for _, result := range results {
+		key := result.ProxyUsed.key()
+		grouped[key] = append(grouped[key], result)
+	}
+
+	sorted := make([]ProxyTestResult, 0, len(results))
+
+	for _, agg := range aggregates {
+		sorted = append(sorted, grouped[agg.Proxy.key()]...)
+	}
+
+	return sorted
+}
+
+//printMatrix renders a compact per-proxy x per-endpoint status/latency table, best score first
+func printMatrix(aggregates []ProxyAggregate, endpoints []EndpointSpec) {
+
+	header := color.New(color.FgHiCyan)
+
+	header.Print("PROXY")
+
+	for _, endpoint := range endpoints {
+		header.Print("\t", endpoint.URL)
+	}
+
+	header.Println("\tSCORE")
+
+	success := color.New(color.FgHiGreen)
+	failed := color.New(color.FgHiRed)
+
+	for _, agg := range aggregates {
+
+		fmt.Print(agg.Proxy.rawString())
+
+		for _, endpoint := range endpoints {
+
+			result, ok := agg.Endpoints[endpoint.URL]
+
+			if !ok {
+				fmt.Print("\t-")
+				continue
+			}
+
+			if result.Success {
+				success.Print("\t", result.StatusCode, " (", result.Latency.Round(time.Millisecond), ")")
+			} else {
+				failed.Print("\t", result.StatusCode)
+			}
+		}
+
+		fmt.Printf("\t%.1f\n", agg.Score)
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/fatih/color"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+//consecutive check thresholds used to move a proxy between the healthy and unhealthy sets,
+//and the interval used when a Config doesn't set health_check_interval
+const (
+	unhealthyAfterFailures = 3
+	healthyAfterSuccesses  = 2
+	ewmaSmoothingFactor    = 0.3
+	defaultWatchInterval   = time.Minute
+	defaultStatsFile       = "proxy_stats.json"
+)
+
+//ProxyStats holds the rolling health of a single proxy, keyed by its key() in HealthTracker
+type ProxyStats struct {
+	Successes            int
+	Failures             int
+	LastLatency          time.Duration
+	EWMALatency          time.Duration
+	LastChecked          time.Time
+	ConsecutiveFailures  int
+	ConsecutiveSuccesses int
+	Healthy              bool
+}
+
+//HealthTracker keeps rolling success/latency stats per proxy and moves proxies between
+//the healthy and unhealthy sets as their consecutive pass/fail streaks cross the
+//unhealthyAfterFailures/healthyAfterSuccesses thresholds
+type HealthTracker struct {
+	mu      sync.RWMutex
+	stats   map[string]*ProxyStats
+	proxies map[string]Proxy
+}
+
+//NewHealthTracker creates an empty HealthTracker. Proxies are considered healthy until
+//proven otherwise, so they're eligible for use as soon as they're first seen
+func NewHealthTracker() *HealthTracker {
+	return &HealthTracker{stats: make(map[string]*ProxyStats), proxies: make(map[string]Proxy)}
+}
+
+//ProxyCandidate pairs a Proxy with its current health stats, used by the serve gateway
+//to pick an upstream
+type ProxyCandidate struct {
+	Proxy Proxy
+	Stats ProxyStats
+}
+
+//Record folds one health-check cycle's verdict for proxy into its rolling stats. Callers
+//must collapse a cycle's (possibly multi-endpoint) results down to a single pass/fail first
+//(see cycleVerdict) so ConsecutiveFailures/ConsecutiveSuccesses track across cycles, not
+//across endpoints within the same cycle
+func (h *HealthTracker) Record(proxy Proxy, success bool, latency time.Duration) {
+
+	key := proxy.key()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.proxies[key] = proxy
+
+	stat, ok := h.stats[key]
+
+	if !ok {
+		stat = &ProxyStats{Healthy: true}
+		h.stats[key] = stat
+	}
+
+	stat.LastChecked = time.Now()
+	stat.LastLatency = latency
+
+	if stat.EWMALatency == 0 {
+		stat.EWMALatency = latency
+	} else {
+		stat.EWMALatency = time.Duration(ewmaSmoothingFactor*float64(latency) + (1-ewmaSmoothingFactor)*float64(stat.EWMALatency))
+	}
+
+	if success {
+		stat.Successes++
+		stat.ConsecutiveSuccesses++
+		stat.ConsecutiveFailures = 0
+
+		if !stat.Healthy && stat.ConsecutiveSuccesses >= healthyAfterSuccesses {
+			stat.Healthy = true
+		}
+	} else {
+		stat.Failures++
+		stat.ConsecutiveFailures++
+		stat.ConsecutiveSuccesses = 0
+
+		if stat.Healthy && stat.ConsecutiveFailures >= unhealthyAfterFailures {
+			stat.Healthy = false
+		}
+	}
+}
+
+//cycleVerdict collapses one proxy's per-endpoint results for a single health-check cycle
+//into one pass/fail plus a representative latency: success if it passed at least one
+//endpoint (mirrors scoreAggregate's tolerance for a proxy that's merely banned on one
+//site), with latency averaged across the endpoints it passed
+func cycleVerdict(agg ProxyAggregate) (success bool, latency time.Duration) {
+
+	var successes int
+	var totalLatency time.Duration
+
+	for _, result := range agg.Endpoints {
+		if result.Success {
+			successes++
+			totalLatency += result.Latency
+		}
+	}
+
+	if successes == 0 {
+		return false, 0
+	}
+
+	return true, totalLatency / time.Duration(successes)
+}
+
+//Stats returns a snapshot copy of the stats for every proxy seen so far
+func (h *HealthTracker) Stats() map[string]ProxyStats {
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	snapshot := make(map[string]ProxyStats, len(h.stats))
+
+	for key, stat := range h.stats {
+		snapshot[key] = *stat
+	}
+
+	return snapshot
+}
+
+//HealthyProxies returns the key() of every proxy currently considered healthy
+func (h *HealthTracker) HealthyProxies() []string {
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var healthy []string
+
+	for key, stat := range h.stats {
+		if stat.Healthy {
+			healthy = append(healthy, key)
+		}
+	}
+
+	return healthy
+}
+
+//HealthyCandidates returns a Proxy+ProxyStats pair for every proxy currently considered
+//healthy, for use by the serve gateway's upstream selection strategies
+func (h *HealthTracker) HealthyCandidates() []ProxyCandidate {
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	var candidates []ProxyCandidate
+
+	for key, stat := range h.stats {
+
+		if !stat.Healthy {
+			continue
+		}
+
+		if proxy, ok := h.proxies[key]; ok {
+			candidates = append(candidates, ProxyCandidate{Proxy: proxy, Stats: *stat})
+		}
+	}
+
+	return candidates
+}
+
+//SaveToFile persists the current stats as JSON so a restart doesn't lose history
+func (h *HealthTracker) SaveToFile(filePath string) error {
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	data, err := json.MarshalIndent(h.stats, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filePath, data, 0644)
+}
+
+//LoadHealthTracker reads previously persisted stats back from filePath. A missing file is
+//not an error; it just means this is the first run
+func LoadHealthTracker(filePath string) (*HealthTracker, error) {
+
+	tracker := NewHealthTracker()
+
+	data, err := ioutil.ReadFile(filePath)
+
+	if err != nil {
+		if os.IsNotExist(err) {
+			return tracker, nil
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &tracker.stats); err != nil {
+		return nil, err
+	}
+
+	return tracker, nil
+}
+
+//healthLoop is the machinery shared by -watch and the serve subcommand: a HealthTracker
+//loaded from disk plus everything needed to repeatedly re-test cfg's proxies into it
+type healthLoop struct {
+	cfg       *Config
+	proxies   []Proxy
+	tracker   *HealthTracker
+	tester    *Tester
+	statsFile string
+	interval  time.Duration
+}
+
+//newHealthLoop builds a healthLoop from cfg: loads proxies, restores any persisted stats
+//file, and sizes the tester/interval off the config (falling back to defaults)
+func newHealthLoop(cfg *Config) (*healthLoop, error) {
+
+	proxies := cfg.proxies()
+
+	if len(proxies) == 0 {
+		return nil, errors.New("no proxies found in proxy_pool_ours or proxy_pool_thirdparty")
+	}
+
+	statsFile := cfg.StatsFile
+
+	if statsFile == "" {
+		statsFile = defaultStatsFile
+	}
+
+	tracker, err := LoadHealthTracker(statsFile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	interval := defaultWatchInterval
+
+	if cfg.HealthCheckInterval > 0 {
+		interval = time.Duration(cfg.HealthCheckInterval) * time.Second
+	}
+
+	timeout := defaultConnectTimeout
+
+	if cfg.ProxyConnectTimeout > 0 {
+		timeout = time.Duration(cfg.ProxyConnectTimeout) * time.Second
+	}
+
+	return &healthLoop{
+		cfg:       cfg,
+		proxies:   proxies,
+		tracker:   tracker,
+		tester:    NewTester(cfg.ProxyCheckers, timeout),
+		statsFile: statsFile,
+		interval:  interval,
+	}, nil
+}
+
+//checkOnce re-tests every proxy against every configured endpoint, then collapses each
+//proxy's results across all of this cycle's endpoints into a single pass/fail (via
+//cycleVerdict) before folding it into the tracker, so a proxy tested against several
+//endpoints racks up at most one streak update per cycle, not one per endpoint
+func (l *healthLoop) checkOnce() {
+
+	var allResults []ProxyTestResult
+
+	for _, endpoint := range l.cfg.Endpoints {
+
+		results, err := l.tester.Run(l.proxies, endpoint)
+
+		if err != nil {
+			color.Red(err.Error())
+			continue
+		}
+
+		allResults = append(allResults, results...)
+	}
+
+	for _, agg := range aggregateResults(allResults) {
+		success, latency := cycleVerdict(agg)
+		l.tracker.Record(agg.Proxy, success, latency)
+	}
+
+	color.Cyan("Healthy proxies: %d/%d", len(l.tracker.HealthyProxies()), len(l.proxies))
+}
+
+//runUntil re-checks on l.interval until stop is closed
+func (l *healthLoop) runUntil(stop <-chan struct{}) {
+
+	l.checkOnce()
+
+	ticker := time.NewTicker(l.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+
+		case <-ticker.C:
+			l.checkOnce()
+
+		case <-stop:
+			return
+		}
+	}
+}
+
+//runWatch implements the -watch long-running mode: it re-tests every proxy against every
+//configured endpoint on a loop, folding results into a HealthTracker, and persists the
+//tracker's stats to cfg.StatsFile (proxy_stats.json when unset) on SIGINT/SIGTERM so a
+//restart keeps its history
+func runWatch(cfg *Config) error {
+
+	loop, err := newHealthLoop(cfg)
+
+	if err != nil {
+		return err
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+
+	stop := make(chan struct{})
+
+	go loop.runUntil(stop)
+
+	<-sigCh
+	close(stop)
+
+	color.Yellow("Shutting down, saving stats to \"%s\"...", loop.statsFile)
+	return loop.tracker.SaveToFile(loop.statsFile)
+}
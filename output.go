@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+)
+
+//ResultWriter persists a batch of ProxyTestResults in some human- or machine-readable
+//format. Selected via the -output flag (text|json|csv|prom); new formats are drop-in
+type ResultWriter interface {
+	Write(results []ProxyTestResult) error
+}
+
+//newResultWriter builds the ResultWriter for the given -output value
+func newResultWriter(format string) (ResultWriter, error) {
+
+	switch format {
+
+	case "", "text":
+		return textResultWriter{}, nil
+
+	case "json":
+		return jsonResultWriter{}, nil
+
+	case "csv":
+		return csvResultWriter{}, nil
+
+	case "prom":
+		return promResultWriter{}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown -output format %q (want text, json, csv, or prom)", format)
+	}
+}
+
+//splitGoodBad classifies one line per proxy by its aggregate score across every endpoint
+//it was tested against (a proxy that passes at least one endpoint has a positive score and
+//is "good" overall, even if it fails or gets a captcha page on another), so a
+//multi-endpoint run doesn't duplicate or split a single proxy across working.txt/failed.txt
+func splitGoodBad(aggregates []ProxyAggregate) (good []string, bad []string) {
+
+	for _, agg := range aggregates {
+		if agg.Score > 0 {
+			good = append(good, agg.Proxy.rawString())
+		} else {
+			bad = append(bad, agg.Proxy.rawString())
+		}
+	}
+
+	return good, bad
+}
+
+//textResultWriter is the original behavior: raw ip:port lines appended to working.txt/failed.txt
+type textResultWriter struct{}
+
+func (textResultWriter) Write(results []ProxyTestResult) error {
+
+	good, bad := splitGoodBad(aggregateResults(results))
+
+	if err := writeArrayToFile(good, "working.txt"); err != nil {
+		return err
+	}
+
+	return writeArrayToFile(bad, "failed.txt")
+}
+
+//resultEntry is the common shape emitted by the structured writers (json/csv)
+type resultEntry struct {
+	IP         string `json:"ip"`
+	Port       string `json:"port"`
+	Protocol   string `json:"protocol"`
+	Endpoint   string `json:"endpoint"`
+	StatusCode int    `json:"status_code"`
+	LatencyMs  int64  `json:"latency_ms"`
+	Success    bool   `json:"success"`
+	Error      string `json:"error,omitempty"`
+}
+
+//toResultEntries flattens ProxyTestResults into the structured writers' common shape
+func toResultEntries(results []ProxyTestResult) []resultEntry {
+
+	entries := make([]resultEntry, 0, len(results))
+
+	for _, result := range results {
+		entries = append(entries, resultEntry{
+			IP:         result.ProxyUsed.IP,
+			Port:       result.ProxyUsed.Port,
+			Protocol:   result.ProxyUsed.Protocol,
+			Endpoint:   result.Endpoint,
+			StatusCode: result.StatusCode,
+			LatencyMs:  result.Speed.Milliseconds(),
+			Success:    result.Success,
+			Error:      result.Error,
+		})
+	}
+
+	return entries
+}
+
+//jsonResultWriter writes one JSON object per proxy/endpoint pair to results.json
+type jsonResultWriter struct{}
+
+func (jsonResultWriter) Write(results []ProxyTestResult) error {
+
+	data, err := json.MarshalIndent(toResultEntries(results), "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile("results.json", data, 0644)
+}
+
+//csvResultWriter writes one row per proxy/endpoint pair, with a header, to results.csv
+type csvResultWriter struct{}
+
+func (csvResultWriter) Write(results []ProxyTestResult) error {
+
+	f, err := os.OpenFile("results.csv", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	defer w.Flush()
+
+	w.Write([]string{"ip", "port", "protocol", "endpoint", "status_code", "latency_ms", "success", "error"})
+
+	for _, entry := range toResultEntries(results) {
+		w.Write([]string{
+			entry.IP,
+			entry.Port,
+			entry.Protocol,
+			entry.Endpoint,
+			strconv.Itoa(entry.StatusCode),
+			strconv.FormatInt(entry.LatencyMs, 10),
+			strconv.FormatBool(entry.Success),
+			entry.Error,
+		})
+	}
+
+	return w.Error()
+}
+
+//promResultWriter writes Prometheus textfile-collector metrics to results.prom, suitable
+//for node_exporter's textfile collector
+type promResultWriter struct{}
+
+func (promResultWriter) Write(results []ProxyTestResult) error {
+
+	var out []byte
+
+	out = append(out, "# HELP proxy_test_latency_seconds Latency of the last proxy test\n"...)
+	out = append(out, "# TYPE proxy_test_latency_seconds gauge\n"...)
+
+	for _, entry := range toResultEntries(results) {
+		out = append(out, fmt.Sprintf("proxy_test_latency_seconds{proxy=%q,endpoint=%q} %f\n",
+			entry.IP+":"+entry.Port, entry.Endpoint, float64(entry.LatencyMs)/1000)...)
+	}
+
+	out = append(out, "# HELP proxy_test_success Whether the last proxy test succeeded\n"...)
+	out = append(out, "# TYPE proxy_test_success gauge\n"...)
+
+	for _, entry := range toResultEntries(results) {
+
+		success := 0
+
+		if entry.Success {
+			success = 1
+		}
+
+		out = append(out, fmt.Sprintf("proxy_test_success{proxy=%q,endpoint=%q} %d\n",
+			entry.IP+":"+entry.Port, entry.Endpoint, success)...)
+	}
+
+	return ioutil.WriteFile("results.prom", out, 0644)
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/fatih/color"
+	socksproxy "golang.org/x/net/proxy"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+//selection strategies accepted in the config's strategy key for the serve subcommand
+const (
+	strategyRoundRobin     = "round-robin"
+	strategyLeastLatency   = "least-latency"
+	strategyRandomWeighted = "random-weighted"
+)
+
+//Gateway is the local HTTP forward-proxy started by the serve subcommand. It picks a
+//healthy upstream proxy from tracker for every request, using strategy to choose between
+//candidates, and routes hosts in bypassDomains through oursPool instead
+type Gateway struct {
+	tracker       *HealthTracker
+	strategy      string
+	bypassDomains []string
+	oursPool      []Proxy
+	rrCounter     uint64
+}
+
+//NewGateway builds a Gateway. strategy must be one of the strategy* constants; an unknown
+//value falls back to round-robin
+func NewGateway(tracker *HealthTracker, strategy string, bypassDomains []string, oursPool []Proxy) *Gateway {
+	return &Gateway{tracker: tracker, strategy: strategy, bypassDomains: bypassDomains, oursPool: oursPool}
+}
+
+//ServeHTTP implements http.Handler, dispatching CONNECT (used for HTTPS targets) separately
+//from plain forwarded requests
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method == http.MethodConnect {
+		g.serveConnect(w, r)
+		return
+	}
+
+	g.serveForward(w, r)
+}
+
+//serveForward proxies a plain (non-CONNECT) request through a chosen upstream, retrying
+//once with the next-best candidate on failure
+func (g *Gateway) serveForward(w http.ResponseWriter, r *http.Request) {
+
+	excluded := map[string]bool{}
+
+	for attempt := 0; attempt < 2; attempt++ {
+
+		upstream, err := g.chooseUpstream(r.Host, excluded)
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		resp, err := g.forwardVia(upstream, r)
+
+		if err != nil {
+			excluded[upstream.key()] = true
+			continue
+		}
+
+		defer resp.Body.Close()
+
+		for key, values := range resp.Header {
+			for _, value := range values {
+				w.Header().Add(key, value)
+			}
+		}
+
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	}
+
+	http.Error(w, "all upstream proxies failed", http.StatusBadGateway)
+}
+
+//forwardVia sends r through upstream's transport and returns the raw response
+func (g *Gateway) forwardVia(upstream Proxy, r *http.Request) (*http.Response, error) {
+
+	transport, err := buildTransport(upstream)
+
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Transport: transport, Timeout: defaultConnectTimeout}
+
+	outReq := r.Clone(r.Context())
+	outReq.RequestURI = ""
+
+	return client.Do(outReq)
+}
+
+//serveConnect hijacks the client connection and tunnels it through a chosen upstream's
+//CONNECT (HTTP(S) proxies) or direct dial (SOCKS proxies), retrying once on failure
+func (g *Gateway) serveConnect(w http.ResponseWriter, r *http.Request) {
+
+	hijacker, ok := w.(http.Hijacker)
+
+	if !ok {
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+
+	excluded := map[string]bool{}
+	var upstreamConn net.Conn
+
+	for attempt := 0; attempt < 2; attempt++ {
+
+		upstream, err := g.chooseUpstream(r.Host, excluded)
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		conn, err := dialUpstreamConnect(r.Context(), upstream, r.Host)
+
+		if err != nil {
+			excluded[upstream.key()] = true
+			continue
+		}
+
+		upstreamConn = conn
+		break
+	}
+
+	if upstreamConn == nil {
+		http.Error(w, "all upstream proxies failed", http.StatusBadGateway)
+		return
+	}
+
+	defer upstreamConn.Close()
+
+	clientConn, _, err := hijacker.Hijack()
+
+	if err != nil {
+		return
+	}
+
+	defer clientConn.Close()
+
+	clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+
+	done := make(chan struct{}, 2)
+
+	go func() {
+		io.Copy(upstreamConn, clientConn)
+		done <- struct{}{}
+	}()
+
+	go func() {
+		io.Copy(clientConn, upstreamConn)
+		done <- struct{}{}
+	}()
+
+	<-done
+}
+
+//dialUpstreamConnect opens a tunnel to targetAddr through upstream, using the upstream's
+//own CONNECT method for HTTP(S) proxies or a direct SOCKS dial for SOCKS4/5 proxies.
+//ctx is the client request's context, so an aborted/timed-out client request doesn't
+//leave the upstream dial running
+func dialUpstreamConnect(ctx context.Context, upstream Proxy, targetAddr string) (net.Conn, error) {
+
+	protocol := strings.ToLower(upstream.Protocol)
+
+	if protocol == protocolSocks4 {
+		return socks4Dial(ctx, upstream.IP+":"+upstream.Port, targetAddr, upstream.User)
+	}
+
+	if protocol == protocolSocks5 {
+
+		var auth *socksproxy.Auth
+
+		if upstream.User != "" && upstream.Pass != "" {
+			auth = &socksproxy.Auth{User: upstream.User, Password: upstream.Pass}
+		}
+
+		dialer, err := socksproxy.SOCKS5("tcp", upstream.IP+":"+upstream.Port, auth, socksproxy.Direct)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return dialer.(socksproxy.ContextDialer).DialContext(ctx, "tcp", targetAddr)
+	}
+
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", upstream.IP+":"+upstream.Port)
+
+	if err != nil {
+		return nil, err
+	}
+
+	connectReq := "CONNECT " + targetAddr + " HTTP/1.1\r\nHost: " + targetAddr + "\r\n"
+
+	if upstream.User != "" && upstream.Pass != "" {
+		connectReq += "Proxy-Authorization: Basic " + basicAuth(upstream.User, upstream.Pass) + "\r\n"
+	}
+
+	connectReq += "\r\n"
+
+	if _, err := conn.Write([]byte(connectReq)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("upstream CONNECT to %s failed: %s", targetAddr, resp.Status)
+	}
+
+	return conn, nil
+}
+
+//chooseUpstream picks an upstream proxy for host, routing bypassDomains matches through
+//oursPool and excluding any proxies already tried this request (by key(), so two proxies
+//sharing an ip:port under different protocols aren't confused for one another)
+func (g *Gateway) chooseUpstream(host string, excluded map[string]bool) (Proxy, error) {
+
+	if g.bypasses(host) {
+
+		var candidates []Proxy
+
+		for _, proxy := range g.oursPool {
+			if !excluded[proxy.key()] {
+				candidates = append(candidates, proxy)
+			}
+		}
+
+		if len(candidates) == 0 {
+			return Proxy{}, errors.New("no proxies available in proxy_pool_ours for bypassed host " + host)
+		}
+
+		return candidates[rand.Intn(len(candidates))], nil
+	}
+
+	var candidates []ProxyCandidate
+
+	for _, candidate := range g.tracker.HealthyCandidates() {
+		if !excluded[candidate.Proxy.key()] {
+			candidates = append(candidates, candidate)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return Proxy{}, errors.New("no healthy upstream proxies available")
+	}
+
+	switch g.strategy {
+
+	case strategyLeastLatency:
+		return leastLatencyCandidate(candidates), nil
+
+	case strategyRandomWeighted:
+		return randomWeightedCandidate(candidates), nil
+
+	default:
+		return g.roundRobinCandidate(candidates), nil
+	}
+}
+
+//bypasses reports whether host (or a subdomain of it) is in the configured bypass list
+func (g *Gateway) bypasses(host string) bool {
+
+	host = stripPort(host)
+
+	for _, domain := range g.bypassDomains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//roundRobinCandidate cycles through candidates in order across calls
+func (g *Gateway) roundRobinCandidate(candidates []ProxyCandidate) Proxy {
+	//HealthyCandidates builds its list from a map, so give it a stable order before indexing
+	sort.Slice(candidates, func(a, b int) bool {
+		return candidates[a].Proxy.key() < candidates[b].Proxy.key()
+	})
+	i := atomic.AddUint64(&g.rrCounter, 1)
+	return candidates[int(i)%len(candidates)].Proxy
+}
+
+//leastLatencyCandidate returns the candidate with the lowest EWMA latency
+func leastLatencyCandidate(candidates []ProxyCandidate) Proxy {
+
+	best := candidates[0]
+
+	for _, candidate := range candidates[1:] {
+		if candidate.Stats.EWMALatency < best.Stats.EWMALatency {
+			best = candidate
+		}
+	}
+
+	return best.Proxy
+}
+
+//randomWeightedCandidate picks randomly, weighting towards lower EWMA latency
+func randomWeightedCandidate(candidates []ProxyCandidate) Proxy {
+
+	weights := make([]float64, len(candidates))
+	var total float64
+
+	for i, candidate := range candidates {
+
+		latency := candidate.Stats.EWMALatency.Seconds()
+
+		if latency <= 0 {
+			latency = 0.001
+		}
+
+		weights[i] = 1 / latency
+		total += weights[i]
+	}
+
+	target := rand.Float64() * total
+	var cumulative float64
+
+	for i, weight := range weights {
+		cumulative += weight
+		if target <= cumulative {
+			return candidates[i].Proxy
+		}
+	}
+
+	return candidates[len(candidates)-1].Proxy
+}
+
+//runServe starts the serve subcommand: a background health loop keeps cfg's proxies'
+//healthy/unhealthy status up to date while an HTTP forward-proxy on cfg.HTTPPort routes
+//client requests through whichever healthy upstream the Gateway selects
+func runServe(cfg *Config) error {
+
+	if cfg.HTTPPort == 0 {
+		return errors.New("config must set http_port for the serve subcommand")
+	}
+
+	loop, err := newHealthLoop(cfg)
+
+	if err != nil {
+		return err
+	}
+
+	var oursPool []Proxy
+
+	for _, line := range cfg.ProxyPoolOurs {
+		if proxy, err := stringToProxy(line, cfg.DefaultProtocol); err == nil {
+			oursPool = append(oursPool, proxy)
+		}
+	}
+
+	gateway := NewGateway(loop.tracker, cfg.Strategy, cfg.BypassDomains, oursPool)
+
+	stop := make(chan struct{})
+	go loop.runUntil(stop)
+
+	server := &http.Server{
+		Addr:    ":" + strconv.Itoa(cfg.HTTPPort),
+		Handler: gateway,
+	}
+
+	go func() {
+		color.Cyan("Serving proxy gateway on :%d", cfg.HTTPPort)
+
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			color.Red(err.Error())
+		}
+	}()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	<-sigCh
+
+	close(stop)
+	server.Close()
+
+	color.Yellow("Shutting down, saving stats to \"%s\"...", loop.statsFile)
+	return loop.tracker.SaveToFile(loop.statsFile)
+}
+
+//stripPort removes a trailing :port from host:port, leaving bare hosts untouched
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+//basicAuth builds the base64 payload for a Proxy-Authorization: Basic header
+func basicAuth(user, pass string) string {
+	return base64.StdEncoding.EncodeToString([]byte(user + ":" + pass))
+}
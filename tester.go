@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+//number of concurrent proxy checks used when the caller doesn't configure one
+const defaultWorkers = 50
+
+//Tester runs proxy checks through a bounded pool of workers instead of one goroutine
+//per proxy, so large proxy lists don't exhaust file descriptors or thrash the network.
+//It's also the entry point for using this module as a library rather than a CLI.
+type Tester struct {
+	Workers int
+	Timeout time.Duration
+}
+
+//NewTester builds a Tester with the given worker count and per-request timeout,
+//falling back to sane defaults for non-positive values
+func NewTester(workers int, timeout time.Duration) *Tester {
+
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+
+	if timeout <= 0 {
+		timeout = defaultConnectTimeout
+	}
+
+	return &Tester{Workers: workers, Timeout: timeout}
+}
+
+//Run tests every proxy against endpoint using t.Workers concurrent workers and
+//returns one ProxyTestResult per proxy
+func (t *Tester) Run(proxies []Proxy, endpoint EndpointSpec) ([]ProxyTestResult, error) {
+
+	if len(proxies) == 0 {
+		return nil, errors.New("no proxies to test")
+	}
+
+	jobs := make(chan Proxy)
+	resultChannel := make(chan ProxyTestResult, t.Workers)
+
+	//producer: feeds every proxy into the jobs channel
+	var producerWG sync.WaitGroup
+	producerWG.Add(1)
+
+	go func() {
+		defer producerWG.Done()
+
+		for _, proxy := range proxies {
+			jobs <- proxy
+		}
+
+		close(jobs)
+	}()
+
+	//consumers: a fixed pool of workers testing proxies as they arrive on jobs
+	var workerWG sync.WaitGroup
+
+	for i := 0; i < t.Workers; i++ {
+
+		workerWG.Add(1)
+
+		go func() {
+			defer workerWG.Done()
+
+			for proxy := range jobs {
+				testProxy(proxy, endpoint, t.Timeout, resultChannel)
+			}
+		}()
+	}
+
+	go func() {
+		producerWG.Wait()
+		workerWG.Wait()
+		close(resultChannel)
+	}()
+
+	results := make([]ProxyTestResult, 0, len(proxies))
+
+	for result := range resultChannel {
+		results = append(results, result)
+	}
+
+	return results, nil
+}